@@ -0,0 +1,1308 @@
+//go:build integration
+
+// Integration tests against a real PostgreSQL, started in Docker with
+// testcontainers-go. They need a Docker daemon and run with:
+//
+//	go test -tags integration ./...
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+)
+
+// postgresImage is the PostgreSQL version the integration tests run against
+const postgresImage = "postgres:16-alpine"
+
+// testDatabaseURL is the connection string of the shared test container
+var testDatabaseURL string
+
+// TestMain starts one PostgreSQL container for the whole package; each test
+// gets its own tables through TABLE_PREFIX (see newTestDatabase)
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+
+	container, err := postgres.Run(ctx, postgresImage,
+		postgres.WithDatabase("urlshortener"),
+		postgres.WithUsername("postgres"),
+		postgres.WithPassword("postgres"),
+		postgres.BasicWaitStrategies(),
+	)
+	if err != nil {
+		testcontainers.TerminateContainer(container)
+		log.Fatal("Failed to start PostgreSQL container: ", err)
+	}
+
+	testDatabaseURL, err = container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		testcontainers.TerminateContainer(container)
+		log.Fatal("Failed to get PostgreSQL connection string: ", err)
+	}
+
+	code := m.Run()
+
+	if err := testcontainers.TerminateContainer(container); err != nil {
+		log.Println("Failed to terminate PostgreSQL container:", err)
+	}
+	os.Exit(code)
+}
+
+// testPrefixes numbers the table prefixes handed out by newTestDatabase
+var testPrefixes atomic.Int64
+
+// newTestDatabase connects to the test container with the configuration
+// LoadConfig reads from env, using a table prefix no other test shares, and
+// creates the schema. The connection is closed when the test ends.
+func newTestDatabase(t *testing.T, env map[string]string) (*Database, *Config) {
+	t.Helper()
+
+	// TABLE_PREFIX only allows [a-z_], so spell the number in letters
+	prefix := "it_"
+	for n := testPrefixes.Add(1); n > 0; n /= 26 {
+		prefix += string(rune('a' + n%26))
+	}
+
+	t.Setenv("DATABASE_URL", testDatabaseURL)
+	t.Setenv("TABLE_PREFIX", prefix+"_")
+	t.Setenv("DB_CONNECT_RETRIES", "1")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal("LoadConfig: ", err)
+	}
+
+	db, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal("NewDatabase: ", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := prepareSchema(db, cfg); err != nil {
+		t.Fatal("prepareSchema: ", err)
+	}
+	return db, cfg
+}
+
+func TestIntegrationSaveAndGetURL(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	id, err := db.SaveURL(&URLMapping{ShortCode: "abc", OriginalURL: "https://example.com/a", Title: "A"})
+	if err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+
+	mapping, exists, err := db.GetURL("abc")
+	if err != nil || !exists {
+		t.Fatalf("GetURL = %v, %v, want the saved link", exists, err)
+	}
+	if mapping.ID != id || mapping.OriginalURL != "https://example.com/a" || mapping.Title != "A" {
+		t.Errorf("GetURL = %+v, want id %d with the saved fields", mapping, id)
+	}
+	if mapping.CreatedAt.IsZero() {
+		t.Error("created_at was not set")
+	}
+
+	if _, exists, err := db.GetURL("missing"); err != nil || exists {
+		t.Errorf("GetURL(missing) = %v, %v, want not found", exists, err)
+	}
+
+	_, err = db.SaveURL(&URLMapping{ShortCode: "abc", OriginalURL: "https://example.com/b"})
+	if !errors.Is(err, ErrCodeExists) {
+		t.Errorf("saving a taken code: err = %v, want ErrCodeExists", err)
+	}
+}
+
+func TestIntegrationGetNextID(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	first, err := db.GetNextID()
+	if err != nil {
+		t.Fatal("GetNextID: ", err)
+	}
+	second, err := db.GetNextID()
+	if err != nil {
+		t.Fatal("GetNextID: ", err)
+	}
+	if first < 1 || second != first+1 {
+		t.Errorf("GetNextID = %d then %d, want consecutive positive IDs", first, second)
+	}
+}
+
+func TestIntegrationCreateURL(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	for i := range 3 {
+		mapping := &URLMapping{OriginalURL: "https://example.com/"}
+		if err := db.CreateURL(mapping); err != nil {
+			t.Fatal("CreateURL: ", err)
+		}
+		if want := generateShortCode(int64(i + 1)); mapping.ShortCode != want {
+			t.Errorf("link %d got code %q, want %q", i+1, mapping.ShortCode, want)
+		}
+
+		saved, exists, err := db.GetURL(mapping.ShortCode)
+		if err != nil || !exists || saved.ID != mapping.ID {
+			t.Errorf("GetURL(%q) = %+v, %v, %v, want id %d", mapping.ShortCode, saved, exists, err, mapping.ID)
+		}
+	}
+}
+
+func TestIntegrationCreateURLFailureBurnsNoID(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	// A trigger makes inserts of one URL fail after the row was written,
+	// the way a constraint or a lost connection would
+	_, err := db.conn.Exec(db.query(`
+		CREATE FUNCTION {prefix}reject_insert() RETURNS trigger AS $$
+		BEGIN
+			IF NEW.original_url = 'https://example.com/reject' THEN
+				RAISE EXCEPTION 'rejected';
+			END IF;
+			RETURN NEW;
+		END $$ LANGUAGE plpgsql;
+		CREATE TRIGGER reject_insert AFTER INSERT ON {prefix}urls
+			FOR EACH ROW EXECUTE FUNCTION {prefix}reject_insert();
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(url string) error {
+		return db.CreateURL(&URLMapping{OriginalURL: url})
+	}
+	if err := create("https://example.com/1"); err != nil {
+		t.Fatal("CreateURL: ", err)
+	}
+
+	// Every kind of failed insert: a rejected row, a taken alias, an import
+	// conflict, a skipped import row and the MAX_ID ceiling
+	if err := create("https://example.com/reject"); err == nil {
+		t.Fatal("CreateURL of a rejected row succeeded")
+	}
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "alias", OriginalURL: "https://example.com/2"}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "alias", OriginalURL: "https://example.com/dup"}); !errors.Is(err, ErrCodeExists) {
+		t.Fatalf("SaveURL of a taken alias: err = %v, want ErrCodeExists", err)
+	}
+	if _, err := db.ImportURLs([]URLMapping{{ShortCode: "alias", OriginalURL: "https://example.com/dup"}}, "", conflictError); !errors.Is(err, ErrCodeConflict) {
+		t.Fatalf("ImportURLs of a taken code: err = %v, want ErrCodeConflict", err)
+	}
+	result, err := db.ImportURLs([]URLMapping{
+		{ShortCode: "alias", OriginalURL: "https://example.com/dup"},
+		{ShortCode: "imported", OriginalURL: "https://example.com/3"},
+	}, "", conflictSkip)
+	if err != nil || result.Imported != 1 || result.Skipped != 1 {
+		t.Fatalf("ImportURLs = %+v, %v, want one imported and one skipped", result, err)
+	}
+	db.maxID = 3
+	if err := create("https://example.com/over"); !errors.Is(err, ErrIDSpaceExhausted) {
+		t.Fatalf("CreateURL past MAX_ID: err = %v, want ErrIDSpaceExhausted", err)
+	}
+	db.maxID = defaultMaxID
+
+	last := &URLMapping{OriginalURL: "https://example.com/4"}
+	if err := db.CreateURL(last); err != nil {
+		t.Fatal("CreateURL: ", err)
+	}
+	if last.ID != 4 || last.ShortCode != generateShortCode(4) {
+		t.Errorf("last link got id %d and code %q, want 4 and %q", last.ID, last.ShortCode, generateShortCode(4))
+	}
+
+	// The committed IDs run 1..4 with no gap, in the order they were made,
+	// and the sequence stands at the last of them
+	rows, err := db.conn.Query(db.query(`SELECT id, original_url FROM {prefix}urls ORDER BY id`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var urls []string
+	for rows.Next() {
+		var id int64
+		var originalURL string
+		if err := rows.Scan(&id, &originalURL); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		urls = append(urls, originalURL)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int64{1, 2, 3, 4}; !slices.Equal(ids, want) {
+		t.Errorf("committed ids = %v, want %v", ids, want)
+	}
+	if want := []string{"https://example.com/1", "https://example.com/2", "https://example.com/3", "https://example.com/4"}; !slices.Equal(urls, want) {
+		t.Errorf("committed links = %v, want %v", urls, want)
+	}
+	if lastValue, next, err := db.GetSequence(); err != nil || lastValue != 4 || next != 5 {
+		t.Errorf("GetSequence = %d, %d, %v, want 4, 5", lastValue, next, err)
+	}
+}
+
+func TestIntegrationCreateURLSkipsTakenCode(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	// An alias spelling the code of id 2 is saved as id 1, so the next
+	// sequential link can't use id 2 and moves on to 3
+	if _, err := db.SaveURL(&URLMapping{ShortCode: generateShortCode(2), OriginalURL: "https://example.com/alias"}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+	mapping := &URLMapping{OriginalURL: "https://example.com/"}
+	if err := db.CreateURL(mapping); err != nil {
+		t.Fatal("CreateURL: ", err)
+	}
+	if mapping.ID != 3 || mapping.ShortCode != generateShortCode(3) {
+		t.Errorf("CreateURL got id %d and code %q, want 3 and %q", mapping.ID, mapping.ShortCode, generateShortCode(3))
+	}
+}
+
+// createTestDatabase creates another database in the test container and
+// returns its connection string
+func createTestDatabase(t *testing.T, name string) string {
+	t.Helper()
+
+	conn, err := sql.Open("postgres", testDatabaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Exec(`CREATE DATABASE ` + name); err != nil {
+		t.Fatal("CREATE DATABASE: ", err)
+	}
+
+	u, err := url.Parse(testDatabaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Path = "/" + name
+	return u.String()
+}
+
+func TestIntegrationReplicaReads(t *testing.T) {
+	// The "replica" is an independent database, so which handle a query
+	// used shows in which rows it can see
+	db, _ := newTestDatabase(t, map[string]string{"DATABASE_REPLICA_URL": createTestDatabase(t, "replica_reads")})
+	replica := &Database{conn: db.replica, prefix: db.prefix}
+	if err := replica.InitSchema(); err != nil {
+		t.Fatal("InitSchema on the replica: ", err)
+	}
+
+	// Writes go to the primary...
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "written", OriginalURL: "https://example.com/w"}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+	var onPrimary bool
+	err := db.conn.QueryRow(db.query(`SELECT EXISTS (SELECT 1 FROM {prefix}urls WHERE short_code = 'written')`)).Scan(&onPrimary)
+	if err != nil || !onPrimary {
+		t.Fatalf("link on the primary = %v, %v, want it there", onPrimary, err)
+	}
+
+	// ...and lookups to the replica, which hasn't "replicated" it
+	if _, exists, err := db.GetURL("written"); err != nil || exists {
+		t.Errorf("GetURL(written) = %v, %v, want it missing from the replica", exists, err)
+	}
+
+	if _, err := replica.SaveURL(&URLMapping{ShortCode: "replicated", OriginalURL: "https://example.com/r"}); err != nil {
+		t.Fatal("SaveURL on the replica: ", err)
+	}
+	if mapping, exists, err := db.GetURL("replicated"); err != nil || !exists || mapping.OriginalURL != "https://example.com/r" {
+		t.Errorf("GetURL(replicated) = %+v, %v, %v, want the replica's row", mapping, exists, err)
+	}
+	if fields, exists, err := db.GetURLFields("replicated", []string{"original_url"}); err != nil || !exists {
+		t.Errorf("GetURLFields(replicated) = %v, %v, %v, want the replica's row", fields, exists, err)
+	}
+}
+
+func TestIntegrationTablePrefix(t *testing.T) {
+	db, _ := newTestDatabase(t, map[string]string{"TABLE_PREFIX": "staging_"})
+
+	for _, table := range []string{"staging_urls", "staging_visits", "staging_urls_id_seq"} {
+		var exists bool
+		if err := db.conn.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists); err != nil || !exists {
+			t.Errorf("%s exists = %v, %v, want it created", table, exists, err)
+		}
+	}
+
+	if err := db.CreateURL(&URLMapping{OriginalURL: "https://example.com/"}); err != nil {
+		t.Fatal("CreateURL: ", err)
+	}
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "custom", OriginalURL: "https://example.com/c"}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+
+	var count int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM staging_urls`).Scan(&count); err != nil || count != 2 {
+		t.Errorf("staging_urls has %d rows (%v), want 2", count, err)
+	}
+	if _, exists, err := db.GetURL("custom"); err != nil || !exists {
+		t.Errorf("GetURL(custom) = %v, %v, want it found in staging_urls", exists, err)
+	}
+}
+
+func TestIntegrationRegenerateURL(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	old := &URLMapping{OriginalURL: "https://example.com/page", Owner: "owner", Title: "Page"}
+	if err := db.CreateURL(old); err != nil {
+		t.Fatal("CreateURL: ", err)
+	}
+	if err := db.RecordVisit("", old.ShortCode, "", "", "DE"); err != nil {
+		t.Fatal("RecordVisit: ", err)
+	}
+
+	if _, exists, err := db.RegenerateURL(old.ShortCode, "someone-else"); !exists || !errors.Is(err, ErrNotOwner) {
+		t.Errorf("RegenerateURL by another owner = %v, %v, want ErrNotOwner", exists, err)
+	}
+	if _, exists, err := db.RegenerateURL("missing", "owner"); exists || err != nil {
+		t.Errorf("RegenerateURL(missing) = %v, %v, want not found", exists, err)
+	}
+
+	mapping, exists, err := db.RegenerateURL(old.ShortCode, "owner")
+	if err != nil || !exists {
+		t.Fatalf("RegenerateURL = %v, %v", exists, err)
+	}
+	if mapping.ShortCode == old.ShortCode || mapping.ShortCode != generateShortCode(mapping.ID) {
+		t.Errorf("new code %q for id %d, old code %q", mapping.ShortCode, mapping.ID, old.ShortCode)
+	}
+
+	if _, exists, err := db.GetURL(old.ShortCode); err != nil || exists {
+		t.Errorf("GetURL(old) = %v, %v, want it deleted", exists, err)
+	}
+	saved, exists, err := db.GetURL(mapping.ShortCode)
+	if err != nil || !exists || saved.OriginalURL != old.OriginalURL || saved.Title != old.Title || saved.Owner != old.Owner {
+		t.Errorf("GetURL(new) = %+v, %v, %v, want the old link's fields", saved, exists, err)
+	}
+
+	var visits int
+	if err := db.conn.QueryRow(db.query(`SELECT COUNT(*) FROM {prefix}visits WHERE short_code = $1`), old.ShortCode).Scan(&visits); err != nil {
+		t.Fatal("counting visits: ", err)
+	}
+	if visits != 0 {
+		t.Errorf("%d visits left under the old code, want them deleted", visits)
+	}
+}
+
+func TestIntegrationDeleteWhere(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	for _, code := range []string{"a_1", "ab", "a_2", "b"} {
+		if _, err := db.SaveURL(&URLMapping{ShortCode: code, OriginalURL: "https://example.com/", Owner: "owner"}); err != nil {
+			t.Fatal("SaveURL: ", err)
+		}
+	}
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "a_other", OriginalURL: "https://example.com/", Owner: "other"}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+	if _, err := db.conn.Exec(db.query(`UPDATE {prefix}urls SET created_at = NOW() - INTERVAL '2 days' WHERE short_code IN ('a_2', 'b')`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.DeleteWhere(nil, "", "owner"); err == nil {
+		t.Error("DeleteWhere without filters succeeded, want an error")
+	}
+
+	// The prefix is compared literally: '_' is not a wildcard
+	if n, err := db.DeleteWhere(nil, "a_", "owner"); err != nil || n != 2 {
+		t.Errorf("DeleteWhere(prefix a_) = %d, %v, want 2", n, err)
+	}
+
+	cutoff := time.Now().Add(-24 * time.Hour)
+	if n, err := db.DeleteWhere(&cutoff, "", "owner"); err != nil || n != 1 {
+		t.Errorf("DeleteWhere(older than a day) = %d, %v, want 1", n, err)
+	}
+
+	for code, want := range map[string]bool{"a_1": false, "a_2": false, "b": false, "ab": true, "a_other": true} {
+		if _, exists, err := db.GetURL(code); err != nil || exists != want {
+			t.Errorf("GetURL(%s) exists = %v, %v, want %v", code, exists, err, want)
+		}
+	}
+}
+
+func TestIntegrationDeleteDropsVisits(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	for _, code := range []string{"one", "two", "old3", "kept"} {
+		if _, err := db.SaveURL(&URLMapping{ShortCode: code, OriginalURL: "https://example.com/", Owner: "owner"}); err != nil {
+			t.Fatal("SaveURL: ", err)
+		}
+		if err := db.RecordVisit("", code, "", "", "DE"); err != nil {
+			t.Fatal("RecordVisit: ", err)
+		}
+	}
+
+	if exists, err := db.DeleteURL("one", "owner"); !exists || err != nil {
+		t.Fatalf("DeleteURL = %v, %v", exists, err)
+	}
+	if deleted, err := db.DeleteURLs([]string{"two"}, "owner"); err != nil || len(deleted) != 1 {
+		t.Fatalf("DeleteURLs = %v, %v", deleted, err)
+	}
+	if n, err := db.DeleteWhere(nil, "old", "owner"); err != nil || n != 1 {
+		t.Fatalf("DeleteWhere = %d, %v", n, err)
+	}
+
+	rows, err := db.conn.Query(db.query(`SELECT short_code FROM {prefix}visits ORDER BY short_code`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, code)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"kept"}; !slices.Equal(codes, want) {
+		t.Errorf("visits left for %v, want %v", codes, want)
+	}
+
+	// A new link under a deleted code starts with no history
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "one", OriginalURL: "https://example.com/new"}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+	if counts, err := db.GetCountryCounts("one"); err != nil || len(counts) != 0 {
+		t.Errorf("GetCountryCounts of the new link = %v, %v, want none", counts, err)
+	}
+}
+
+func TestIntegrationImportURLs(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "old-link", OriginalURL: "https://example.com/old", Owner: "owner"}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+	// "old-link" isn't a sequential code, so only the other row moves the sequence
+	mappings := []URLMapping{
+		{ShortCode: "old-link", OriginalURL: "https://example.com/new"},
+		{ShortCode: generateShortCode(1000), OriginalURL: "https://example.com/imported", Clicks: 7},
+	}
+
+	// error aborts the whole import
+	if _, err := db.ImportURLs(mappings, "owner", conflictError); !errors.Is(err, ErrCodeConflict) {
+		t.Fatalf("ImportURLs(error) err = %v, want ErrCodeConflict", err)
+	}
+	if _, exists, _ := db.GetURL(mappings[1].ShortCode); exists {
+		t.Error("an aborted import kept its other rows")
+	}
+
+	result, err := db.ImportURLs(mappings, "owner", conflictSkip)
+	if err != nil || *result != (ImportResult{Imported: 1, Skipped: 1}) {
+		t.Errorf("ImportURLs(skip) = %+v, %v", result, err)
+	}
+	if mapping, _, _ := db.GetURL("old-link"); mapping == nil || mapping.OriginalURL != "https://example.com/old" {
+		t.Errorf("skipped link = %+v, want it unchanged", mapping)
+	}
+
+	result, err = db.ImportURLs(mappings[:1], "owner", conflictOverwrite)
+	if err != nil || *result != (ImportResult{Overwritten: 1}) {
+		t.Errorf("ImportURLs(overwrite) = %+v, %v", result, err)
+	}
+	if mapping, _, _ := db.GetURL("old-link"); mapping == nil || mapping.OriginalURL != "https://example.com/new" {
+		t.Errorf("overwritten link = %+v, want the imported destination", mapping)
+	}
+	result, err = db.ImportURLs(mappings[:1], "someone-else", conflictOverwrite)
+	if err != nil || *result != (ImportResult{Skipped: 1}) {
+		t.Errorf("ImportURLs(overwrite) by another owner = %+v, %v, want it skipped", result, err)
+	}
+
+	// The sequence moved past the imported code, so new codes can't collide with it
+	next := &URLMapping{OriginalURL: "https://example.com/next"}
+	if err := db.CreateURL(next); err != nil {
+		t.Fatal("CreateURL: ", err)
+	}
+	if next.ID != 1001 {
+		t.Errorf("next sequential id = %d, want 1001", next.ID)
+	}
+}
+
+func TestIntegrationGetURLCaseInsensitive(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	for _, code := range []string{"abc", "aBc", "abcd"} {
+		if _, err := db.SaveURL(&URLMapping{ShortCode: code, OriginalURL: "https://example.com/" + code}); err != nil {
+			t.Fatal("SaveURL: ", err)
+		}
+	}
+
+	mappings, err := db.GetURLCaseInsensitive("ABC")
+	if err != nil {
+		t.Fatal("GetURLCaseInsensitive: ", err)
+	}
+	var codes []string
+	for _, m := range mappings {
+		codes = append(codes, m.ShortCode)
+	}
+	if want := []string{"abc", "aBc"}; !slices.Equal(codes, want) {
+		t.Errorf("GetURLCaseInsensitive(ABC) = %v, want %v", codes, want)
+	}
+
+	if _, exists, err := db.GetURL("ABC"); err != nil || exists {
+		t.Errorf("GetURL(ABC) = %v, %v, want the exact lookup to miss", exists, err)
+	}
+}
+
+func TestIntegrationListRecentURLs(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	var want []int64
+	for range 7 {
+		mapping := &URLMapping{OriginalURL: "https://example.com/", Owner: "owner"}
+		if err := db.CreateURL(mapping); err != nil {
+			t.Fatal("CreateURL: ", err)
+		}
+		want = append([]int64{mapping.ID}, want...)
+	}
+	if err := db.CreateURL(&URLMapping{OriginalURL: "https://example.com/", Owner: "other"}); err != nil {
+		t.Fatal("CreateURL: ", err)
+	}
+
+	var ids []int64
+	for afterID := int64(0); ; {
+		page, err := db.ListRecentURLs("owner", afterID, 3)
+		if err != nil {
+			t.Fatal("ListRecentURLs: ", err)
+		}
+		for _, m := range page {
+			ids = append(ids, m.ID)
+		}
+		if len(page) < 3 {
+			break
+		}
+		afterID = page[len(page)-1].ID
+	}
+
+	if !slices.Equal(ids, want) {
+		t.Errorf("paged ids = %v, want %v", ids, want)
+	}
+}
+
+func TestIntegrationCreateURLConcurrent(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	const links = 50
+	mappings := make([]*URLMapping, links)
+	var wg sync.WaitGroup
+	for i := range links {
+		mappings[i] = &URLMapping{OriginalURL: "https://example.com/"}
+		wg.Go(func() {
+			if err := db.CreateURL(mappings[i]); err != nil {
+				t.Errorf("CreateURL %d: %v", i, err)
+			}
+		})
+	}
+	wg.Wait()
+
+	// Serialized allocation hands out exactly 1..links
+	ids := make([]int64, 0, links)
+	seen := make(map[string]bool)
+	for _, m := range mappings {
+		ids = append(ids, m.ID)
+		if seen[m.ShortCode] {
+			t.Errorf("code %q issued twice", m.ShortCode)
+		}
+		seen[m.ShortCode] = true
+
+		if id, err := decodeShortCode(m.ShortCode); err != nil || id != m.ID {
+			t.Errorf("code %q decodes to %d (%v), want id %d", m.ShortCode, id, err, m.ID)
+		}
+		if saved, exists, err := db.GetURL(m.ShortCode); err != nil || !exists || saved.ID != m.ID {
+			t.Errorf("GetURL(%q) = %+v, %v, %v, want id %d", m.ShortCode, saved, exists, err, m.ID)
+		}
+	}
+	slices.Sort(ids)
+	if ids[0] != 1 || ids[links-1] != links {
+		t.Errorf("ids run from %d to %d, want 1 to %d without gaps", ids[0], ids[links-1], links)
+	}
+}
+
+func TestIntegrationGetURLFields(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "abc", OriginalURL: "https://example.com/", Title: "Home"}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+
+	fields, exists, err := db.GetURLFields("abc", []string{"short_code", "original_url", "clicks", "title", "description", "expires_at"})
+	if err != nil || !exists {
+		t.Fatalf("GetURLFields = %v, %v", exists, err)
+	}
+	// NULL columns are left out
+	if got := slices.Sorted(maps.Keys(fields)); !slices.Equal(got, []string{"clicks", "original_url", "short_code", "title"}) {
+		t.Errorf("keys = %v", got)
+	}
+	if fields["original_url"] != "https://example.com/" || fields["title"] != "Home" {
+		t.Errorf("fields = %v", fields)
+	}
+
+	if _, _, err := db.GetURLFields("abc", []string{"short_code; DROP TABLE urls"}); err == nil {
+		t.Error("GetURLFields accepted a field outside the whitelist")
+	}
+	if _, exists, err := db.GetURLFields("missing", []string{"clicks"}); err != nil || exists {
+		t.Errorf("GetURLFields(missing) = %v, %v, want not found", exists, err)
+	}
+}
+
+func TestIntegrationSequence(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	// A fresh sequence hands out its start value first
+	if last, next, err := db.GetSequence(); err != nil || last != 1 || next != 1 {
+		t.Errorf("GetSequence on a new table = %d, %d, %v, want 1, 1", last, next, err)
+	}
+
+	for range 3 {
+		if err := db.CreateURL(&URLMapping{OriginalURL: "https://example.com/"}); err != nil {
+			t.Fatal("CreateURL: ", err)
+		}
+	}
+	if last, next, err := db.GetSequence(); err != nil || last != 3 || next != 4 {
+		t.Errorf("GetSequence = %d, %d, %v, want 3, 4", last, next, err)
+	}
+
+	for _, value := range []int64{2, 3} {
+		if err := db.SetSequence(value); !errors.Is(err, ErrSequenceTooLow) {
+			t.Errorf("SetSequence(%d) = %v, want ErrSequenceTooLow", value, err)
+		}
+	}
+
+	if err := db.SetSequence(500); err != nil {
+		t.Fatal("SetSequence: ", err)
+	}
+	if last, next, err := db.GetSequence(); err != nil || last != 500 || next != 501 {
+		t.Errorf("GetSequence after setval = %d, %d, %v, want 500, 501", last, next, err)
+	}
+	mapping := &URLMapping{OriginalURL: "https://example.com/"}
+	if err := db.CreateURL(mapping); err != nil || mapping.ID != 501 {
+		t.Errorf("CreateURL after setval got id %d (%v), want 501", mapping.ID, err)
+	}
+}
+
+func TestIntegrationConsumeClickConcurrent(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	const maxClicks, visitors = 5, 40
+	mapping := &URLMapping{ShortCode: "token", OriginalURL: "https://example.com/", MaxClicks: maxClicks}
+	id, err := db.SaveURL(mapping)
+	if err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for range visitors {
+		wg.Go(func() {
+			_, ok, err := db.ConsumeClick(id)
+			if err != nil {
+				t.Error("ConsumeClick: ", err)
+			}
+			if ok {
+				allowed.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+
+	if allowed.Load() != maxClicks {
+		t.Errorf("%d clicks allowed, want exactly %d", allowed.Load(), maxClicks)
+	}
+	saved, _, err := db.GetURL("token")
+	if err != nil || saved.Clicks != maxClicks || !saved.Disabled {
+		t.Errorf("GetURL = %+v, %v, want %d clicks and disabled", saved, err, maxClicks)
+	}
+}
+
+func TestIntegrationDBStats(t *testing.T) {
+	db, cfg := newTestDatabase(t, map[string]string{"API_KEYS": testKeyA})
+	e := echo.New()
+	t.Cleanup(registerRoutes(e, db, cfg))
+
+	// Run some queries through the pool first
+	for range 3 {
+		expectStatus(t, serve(e, http.MethodPost, "/shorten", `{"url":"https://example.com/"}`), http.StatusCreated)
+	}
+
+	rec := serve(e, http.MethodGet, "/api/db/stats", "", apiKeyHeader, testKeyA)
+	expectStatus(t, rec, http.StatusOK)
+	if stats := decodeBody[DBStatsResponse](t, rec); stats.OpenConnections < 1 || stats.Idle+stats.InUse != stats.OpenConnections {
+		t.Errorf("pool stats = %+v, want at least one open connection", stats)
+	}
+}
+
+func TestIntegrationSeed(t *testing.T) {
+	db, cfg := newTestDatabase(t, nil)
+
+	// --force, since the container isn't necessarily on localhost
+	if err := runSeed(cfg, []string{"--count=25", "--api-key=" + testKeyA, "--force"}); err != nil {
+		t.Fatal("runSeed: ", err)
+	}
+
+	var count int
+	if err := db.conn.QueryRow(db.query(`SELECT COUNT(*) FROM {prefix}urls`)).Scan(&count); err != nil || count != 25 {
+		t.Errorf("urls has %d rows (%v), want 25", count, err)
+	}
+	if owned, err := db.CountOwnedURLs(hashAPIKey(testKeyA)); err != nil || owned != 25 {
+		t.Errorf("CountOwnedURLs = %d, %v, want 25", owned, err)
+	}
+
+	// New links continue after the seeded ones
+	mapping := &URLMapping{OriginalURL: "https://example.com/"}
+	if err := db.CreateURL(mapping); err != nil || mapping.ID != 26 {
+		t.Errorf("CreateURL after seeding got id %d (%v), want 26", mapping.ID, err)
+	}
+}
+
+func TestIntegrationGetRank(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	var ids []int64
+	for range 4 {
+		mapping := &URLMapping{OriginalURL: "https://example.com/"}
+		if err := db.CreateURL(mapping); err != nil {
+			t.Fatal("CreateURL: ", err)
+		}
+		ids = append(ids, mapping.ID)
+	}
+	if _, err := db.conn.Exec(db.query(`DELETE FROM {prefix}urls WHERE id = $1`), ids[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range map[int]int64{0: 1, 2: 2, 3: 3} {
+		rank, exists, err := db.GetRank(ids[i], generateShortCode(ids[i]))
+		if err != nil || !exists || rank != want {
+			t.Errorf("GetRank(%d) = %d, %v, %v, want %d", ids[i], rank, exists, err, want)
+		}
+	}
+	if _, exists, err := db.GetRank(ids[1], generateShortCode(ids[1])); err != nil || exists {
+		t.Errorf("GetRank of a deleted id = %v, %v, want not found", exists, err)
+	}
+	if _, exists, err := db.GetRank(ids[0], "wrong"); err != nil || exists {
+		t.Errorf("GetRank with a mismatched code = %v, %v, want not found", exists, err)
+	}
+}
+
+func TestIntegrationDeleteURLs(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+	owner := hashAPIKey(testKeyA)
+
+	for _, m := range []URLMapping{
+		{ShortCode: "a", Owner: owner},
+		{ShortCode: "b", Owner: owner},
+		{ShortCode: "theirs", Owner: hashAPIKey(testKeyB)},
+	} {
+		m.OriginalURL = "https://example.com/"
+		if _, err := db.SaveURL(&m); err != nil {
+			t.Fatal("SaveURL: ", err)
+		}
+	}
+
+	deleted, err := db.DeleteURLs([]string{"a", "missing", "theirs", "a"}, owner)
+	if err != nil {
+		t.Fatal("DeleteURLs: ", err)
+	}
+	if !slices.Equal(deleted, []string{"a"}) {
+		t.Errorf("deleted %v, want [a]", deleted)
+	}
+	for code, want := range map[string]bool{"a": false, "b": true, "theirs": true} {
+		if _, exists, err := db.GetURL(code); err != nil || exists != want {
+			t.Errorf("GetURL(%q) exists = %v (%v), want %v", code, exists, err, want)
+		}
+	}
+}
+
+func TestIntegrationDeleteURL(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "mine", OriginalURL: "https://example.com/", Owner: "owner"}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+
+	if exists, err := db.DeleteURL("mine", "someone-else"); !exists || !errors.Is(err, ErrNotOwner) {
+		t.Errorf("DeleteURL by another owner = %v, %v, want ErrNotOwner", exists, err)
+	}
+	if _, exists, err := db.GetURL("mine"); err != nil || !exists {
+		t.Errorf("GetURL after a refused delete = %v, %v, want the link kept", exists, err)
+	}
+	if exists, err := db.DeleteURL("missing", "owner"); exists || err != nil {
+		t.Errorf("DeleteURL(missing) = %v, %v, want not found", exists, err)
+	}
+
+	if exists, err := db.DeleteURL("mine", "owner"); !exists || err != nil {
+		t.Fatalf("DeleteURL = %v, %v", exists, err)
+	}
+	if _, exists, err := db.GetURL("mine"); err != nil || exists {
+		t.Errorf("GetURL after delete = %v, %v, want it gone", exists, err)
+	}
+}
+
+func TestIntegrationSaveURLErrors(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "dup", OriginalURL: "https://example.com/"}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+	_, err := db.SaveURL(&URLMapping{ShortCode: "dup", OriginalURL: "https://example.com/"})
+	var pqErr *pq.Error
+	if !errors.Is(err, ErrCodeExists) || !errors.As(err, &pqErr) {
+		t.Errorf("duplicate insert: err = %v, want ErrCodeExists wrapping the driver error", err)
+	}
+
+	// A failure for any other reason is not a collision
+	_, err = db.SaveURL(&URLMapping{ShortCode: strings.Repeat("x", 21), OriginalURL: "https://example.com/"})
+	if err == nil || errors.Is(err, ErrCodeExists) {
+		t.Errorf("over-long code: err = %v, want a plain error", err)
+	}
+}
+
+func TestIntegrationNamespaces(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	for _, namespace := range []string{"", "proj1", "proj2"} {
+		if _, err := db.SaveURL(&URLMapping{Namespace: namespace, ShortCode: "abc", OriginalURL: "https://example.com/" + namespace}); err != nil {
+			t.Fatalf("SaveURL in %q: %v", namespace, err)
+		}
+	}
+	if _, err := db.SaveURL(&URLMapping{Namespace: "proj1", ShortCode: "abc", OriginalURL: "https://example.com/"}); !errors.Is(err, ErrCodeExists) {
+		t.Errorf("reusing proj1/abc: err = %v, want ErrCodeExists", err)
+	}
+
+	for _, namespace := range []string{"", "proj1", "proj2"} {
+		mapping, exists, err := db.GetNamespacedURL(namespace, "abc")
+		if err != nil || !exists || mapping.OriginalURL != "https://example.com/"+namespace || mapping.Namespace != namespace {
+			t.Errorf("GetNamespacedURL(%q) = %+v, %v, %v", namespace, mapping, exists, err)
+		}
+	}
+	if _, exists, err := db.GetNamespacedURL("proj3", "abc"); err != nil || exists {
+		t.Errorf("GetNamespacedURL(proj3) = %v, %v, want not found", exists, err)
+	}
+}
+
+func TestIntegrationGetVisitCounts(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	day := func(d, h int) time.Time { return time.Date(2026, 3, d, h, 30, 0, 0, time.UTC) }
+	for _, at := range []time.Time{day(1, 9), day(1, 23), day(3, 0), day(3, 0), day(3, 5), day(9, 12)} {
+		if _, err := db.conn.Exec(db.query(`INSERT INTO {prefix}visits (short_code, visited_at) VALUES ('abc', $1)`), at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts, err := db.GetVisitCounts("abc", bucketDay, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal("GetVisitCounts: ", err)
+	}
+	want := map[time.Time]int64{
+		time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC): 2,
+		time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC): 3,
+	}
+	if !maps.Equal(counts, want) {
+		t.Errorf("by day = %v, want %v", counts, want)
+	}
+
+	counts, err = db.GetVisitCounts("abc", bucketHour, time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC), day(3, 6))
+	if err != nil {
+		t.Fatal("GetVisitCounts: ", err)
+	}
+	want = map[time.Time]int64{
+		time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC): 2,
+		time.Date(2026, 3, 3, 5, 0, 0, 0, time.UTC): 1,
+	}
+	if !maps.Equal(counts, want) {
+		t.Errorf("by hour = %v, want %v", counts, want)
+	}
+}
+
+func TestIntegrationGetURLs(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	past := time.Now().Add(-time.Hour)
+	for _, m := range []URLMapping{
+		{ShortCode: "old", ExpiresAt: &past},
+		{ShortCode: "live"},
+		{Namespace: "proj", ShortCode: "scoped"},
+	} {
+		m.OriginalURL = "https://example.com/"
+		if _, err := db.SaveURL(&m); err != nil {
+			t.Fatal("SaveURL: ", err)
+		}
+	}
+
+	// Expired links are returned too (callers decide what to make of them);
+	// unknown codes and other namespaces are not
+	mappings, err := db.GetURLs([]string{"old", "live", "scoped", "unknown"})
+	if err != nil {
+		t.Fatal("GetURLs: ", err)
+	}
+	if got := slices.Sorted(maps.Keys(mappings)); !slices.Equal(got, []string{"live", "old"}) {
+		t.Errorf("GetURLs returned %v, want [live old]", got)
+	}
+	if m := mappings["old"]; !m.Expired() {
+		t.Errorf("old = %+v, want it expired", m)
+	}
+}
+
+func TestIntegrationCreatedFrom(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	for code, origin := range map[string]string{"tagged": "https://partner.example", "untagged": ""} {
+		if _, err := db.SaveURL(&URLMapping{ShortCode: code, OriginalURL: "https://example.com/", CreatedFrom: origin}); err != nil {
+			t.Fatal("SaveURL: ", err)
+		}
+
+		// A missing origin is stored as NULL, and read back as ""
+		var stored sql.NullString
+		if err := db.conn.QueryRow(db.query(`SELECT created_from FROM {prefix}urls WHERE short_code = $1`), code).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored.Valid != (origin != "") || stored.String != origin {
+			t.Errorf("%s: created_from column = %+v, want %q", code, stored, origin)
+		}
+		mapping, _, err := db.GetURL(code)
+		if err != nil {
+			t.Fatal("GetURL: ", err)
+		}
+		if mapping.CreatedFrom != origin {
+			t.Errorf("%s: GetURL created_from = %q, want %q", code, mapping.CreatedFrom, origin)
+		}
+	}
+}
+
+func TestIntegrationSummary(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	empty, err := db.Summary()
+	if err != nil {
+		t.Fatal("Summary: ", err)
+	}
+	if *empty != (SummaryResponse{}) {
+		t.Errorf("empty Summary = %+v, want zeroes", empty)
+	}
+
+	links := []struct {
+		code   string
+		clicks int64
+		age    time.Duration
+	}{
+		{"a", 10, 72 * time.Hour},
+		{"b", 5, 25 * time.Hour},
+		{"c", 0, 23 * time.Hour},
+		{"d", 2, time.Hour},
+	}
+	for _, l := range links {
+		_, err := db.conn.Exec(db.query(`
+			INSERT INTO {prefix}urls (short_code, original_url, clicks, created_at) 
+			VALUES ($1, 'https://example.com/', $2, CURRENT_TIMESTAMP - $3 * INTERVAL '1 second')
+		`), l.code, l.clicks, l.age.Seconds())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary, err := db.Summary()
+	if err != nil {
+		t.Fatal("Summary: ", err)
+	}
+	if summary.TotalLinks != 4 || summary.TotalClicks != 17 || summary.LinksLast24h != 2 {
+		t.Errorf("Summary = %+v, want 4 links, 17 clicks, 2 in the last day", summary)
+	}
+	if summary.LatestCreatedAt == nil || time.Since(*summary.LatestCreatedAt) > 2*time.Hour {
+		t.Errorf("latest_created_at = %v, want about an hour ago", summary.LatestCreatedAt)
+	}
+}
+
+func TestIntegrationReclaimExpiredCode(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+	logged := captureLog(t)
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	for _, m := range []URLMapping{
+		{ShortCode: "stale", OriginalURL: "https://example.com/old", ExpiresAt: &past},
+		{ShortCode: "live", OriginalURL: "https://example.com/live", ExpiresAt: &future},
+		{ShortCode: "forever", OriginalURL: "https://example.com/forever"},
+	} {
+		if _, err := db.SaveURL(&m); err != nil {
+			t.Fatal("SaveURL: ", err)
+		}
+	}
+	if err := db.RecordVisit("", "stale", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Live codes can't be claimed
+	for _, code := range []string{"live", "forever"} {
+		if _, err := db.SaveURL(&URLMapping{ShortCode: code, OriginalURL: "https://example.com/new"}); !errors.Is(err, ErrCodeExists) {
+			t.Errorf("claiming %s: err = %v, want ErrCodeExists", code, err)
+		}
+	}
+
+	// An expired one is reclaimed, and the old link's visits go with it
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "stale", OriginalURL: "https://example.com/new"}); err != nil {
+		t.Fatal("reclaiming stale: ", err)
+	}
+	mapping, exists, err := db.GetURL("stale")
+	if err != nil || !exists || mapping.OriginalURL != "https://example.com/new" || mapping.ExpiresAt != nil {
+		t.Errorf("GetURL(stale) = %+v, %v, %v, want the new link", mapping, exists, err)
+	}
+	var visits int
+	if err := db.conn.QueryRow(db.query(`SELECT COUNT(*) FROM {prefix}visits WHERE short_code = 'stale'`)).Scan(&visits); err != nil || visits != 0 {
+		t.Errorf("%d visits left on the reclaimed code (%v), want 0", visits, err)
+	}
+	if !strings.Contains(logged.String(), `Reclaimed expired short code "stale"`) {
+		t.Errorf("log = %q, want the reclaim noted", logged)
+	}
+}
+
+func TestIntegrationVerifySchema(t *testing.T) {
+	db, cfg := newTestDatabase(t, nil)
+
+	if err := db.VerifySchema(); err != nil {
+		t.Errorf("VerifySchema after InitSchema: %v", err)
+	}
+
+	// With AUTO_MIGRATE=false, a missing table fails startup by name
+	if _, err := db.conn.Exec(db.query(`DROP TABLE {prefix}visits`)); err != nil {
+		t.Fatal(err)
+	}
+	cfg.AutoMigrate = false
+	err := prepareSchema(db, cfg)
+	if err == nil || !strings.Contains(err.Error(), db.prefix+"visits") || strings.Contains(err.Error(), db.prefix+"urls") {
+		t.Errorf("prepareSchema = %v, want only %svisits reported missing", err, db.prefix)
+	}
+
+	// ... and nothing is created behind the operator's back
+	var exists bool
+	if err := db.conn.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, db.prefix+"visits").Scan(&exists); err != nil || exists {
+		t.Errorf("visits table exists = %v (%v), want it still missing", exists, err)
+	}
+
+	// With AUTO_MIGRATE on, startup recreates it
+	cfg.AutoMigrate = true
+	if err := prepareSchema(db, cfg); err != nil {
+		t.Fatal("prepareSchema: ", err)
+	}
+	if err := db.VerifySchema(); err != nil {
+		t.Errorf("VerifySchema after migrating: %v", err)
+	}
+}
+
+func TestIntegrationCompressURLsMinLength(t *testing.T) {
+	db, _ := newTestDatabase(t, map[string]string{"COMPRESS_URLS": "true", "COMPRESS_URLS_MIN_LENGTH": "1"})
+
+	long := "https://example.com/report?" + strings.Repeat("section=summary&", 40)
+	if _, err := db.SaveURL(&URLMapping{ShortCode: "long", OriginalURL: long}); err != nil {
+		t.Fatal("SaveURL: ", err)
+	}
+
+	var raw string
+	if err := db.conn.QueryRow(db.query(`SELECT original_url FROM {prefix}urls WHERE short_code = 'long'`)).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(raw, compressedURLPrefix) {
+		t.Errorf("stored %q with COMPRESS_URLS_MIN_LENGTH=1, want it compressed", raw)
+	}
+	if mapping, exists, err := db.GetURL("long"); err != nil || !exists || mapping.OriginalURL != long {
+		t.Errorf("GetURL = %+v, %v, %v, want the original URL", mapping, exists, err)
+	}
+}
+
+func TestIntegrationCompressURLs(t *testing.T) {
+	db, _ := newTestDatabase(t, map[string]string{"COMPRESS_URLS": "true"})
+
+	short := "https://example.com/short"
+	long := "https://example.com/report?" + strings.Repeat("section=summary&", 40)
+	for code, url := range map[string]string{"short": short, "long": long} {
+		if _, err := db.SaveURL(&URLMapping{ShortCode: code, OriginalURL: url}); err != nil {
+			t.Fatal("SaveURL: ", err)
+		}
+	}
+	created := &URLMapping{OriginalURL: long}
+	if err := db.CreateURL(created); err != nil {
+		t.Fatal("CreateURL: ", err)
+	}
+
+	// Only long URLs are compressed in the column
+	for code, compressed := range map[string]bool{"short": false, "long": true, created.ShortCode: true} {
+		var stored string
+		if err := db.conn.QueryRow(db.query(`SELECT original_url FROM {prefix}urls WHERE short_code = $1`), code).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(stored, compressedURLPrefix) != compressed {
+			t.Errorf("%s stored as %q, want compressed = %v", code, stored, compressed)
+		}
+	}
+
+	// Every read path returns the original
+	for code, want := range map[string]string{"short": short, "long": long, created.ShortCode: long} {
+		mapping, exists, err := db.GetURL(code)
+		if err != nil || !exists || mapping.OriginalURL != want {
+			t.Errorf("GetURL(%s) = %+v, %v, %v, want %q", code, mapping, exists, err, want)
+		}
+	}
+	mappings, err := db.GetURLs([]string{"short", "long"})
+	if err != nil || mappings["short"].OriginalURL != short || mappings["long"].OriginalURL != long {
+		t.Errorf("GetURLs = %+v, %v, want the originals", mappings, err)
+	}
+}
+
+func TestIntegrationMaxID(t *testing.T) {
+	db, _ := newTestDatabase(t, map[string]string{"MAX_ID": "3"})
+
+	for i := range 3 {
+		if err := db.CreateURL(&URLMapping{OriginalURL: "https://example.com/"}); err != nil {
+			t.Fatalf("CreateURL %d: %v", i+1, err)
+		}
+	}
+
+	// Past the ceiling, inserts fail cleanly and leave no row behind
+	if err := db.CreateURL(&URLMapping{OriginalURL: "https://example.com/"}); !errors.Is(err, ErrIDSpaceExhausted) {
+		t.Errorf("CreateURL past MAX_ID: err = %v, want ErrIDSpaceExhausted", err)
+	}
+	if _, err := db.GetNextID(); !errors.Is(err, ErrIDSpaceExhausted) {
+		t.Errorf("GetNextID past MAX_ID: err = %v, want ErrIDSpaceExhausted", err)
+	}
+	var count int
+	if err := db.conn.QueryRow(db.query(`SELECT COUNT(*) FROM {prefix}urls`)).Scan(&count); err != nil || count != 3 {
+		t.Errorf("urls has %d rows (%v), want 3", count, err)
+	}
+
+	// The real limit of the SERIAL column is reported the same way
+	if _, err := db.conn.Exec(db.query(`SELECT setval('{prefix}urls_id_seq', 2147483647)`)); err != nil {
+		t.Fatal(err)
+	}
+	db.maxID = 0
+	if err := db.CreateURL(&URLMapping{OriginalURL: "https://example.com/"}); !errors.Is(err, ErrIDSpaceExhausted) {
+		t.Errorf("CreateURL past the column's range: err = %v, want ErrIDSpaceExhausted", err)
+	}
+}
+
+func TestIntegrationAnalyzeEndpoint(t *testing.T) {
+	db, cfg := newTestDatabase(t, map[string]string{"API_KEYS": testKeyA})
+	e := echo.New()
+	t.Cleanup(registerRoutes(e, db, cfg))
+
+	for range 50 {
+		if err := db.CreateURL(&URLMapping{OriginalURL: "https://example.com/"}); err != nil {
+			t.Fatal("CreateURL: ", err)
+		}
+	}
+	if _, err := db.conn.Exec(db.query(`DELETE FROM {prefix}urls WHERE id <= 10`)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, serve(e, http.MethodPost, "/api/maintenance/analyze", ""), http.StatusUnauthorized)
+
+	rec := serve(e, http.MethodPost, "/api/maintenance/analyze", "", apiKeyHeader, testKeyA)
+	expectStatus(t, rec, http.StatusOK)
+	report := decodeBody[AnalyzeResponse](t, rec)
+	if report.Table != cfg.TablePrefix+"urls" || report.Rows != 40 {
+		t.Errorf("report = %+v, want 40 rows in %surls", report, cfg.TablePrefix)
+	}
+	if report.TableBytes <= 0 || report.IndexBytes <= 0 || report.TotalBytes < report.TableBytes+report.IndexBytes {
+		t.Errorf("sizes = %+v, want positive table and index sizes within the total", report)
+	}
+	if report.DeadRows < 0 {
+		t.Errorf("dead_rows = %d", report.DeadRows)
+	}
+}
+
+func TestIntegrationRenameURL(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	old := &URLMapping{OriginalURL: "https://example.com/page", Owner: "owner"}
+	if err := db.CreateURL(old); err != nil {
+		t.Fatal("CreateURL: ", err)
+	}
+	taken := &URLMapping{OriginalURL: "https://example.com/taken"}
+	if err := db.CreateURL(taken); err != nil {
+		t.Fatal("CreateURL: ", err)
+	}
+	if _, err := db.IncrementClicks(old.ShortCode); err != nil {
+		t.Fatal("IncrementClicks: ", err)
+	}
+	if err := db.RecordVisit("", old.ShortCode, "", "", ""); err != nil {
+		t.Fatal("RecordVisit: ", err)
+	}
+
+	if _, exists, err := db.RenameURL(old.ShortCode, "fresh", "someone-else"); !exists || !errors.Is(err, ErrNotOwner) {
+		t.Errorf("RenameURL by another owner = %v, %v, want ErrNotOwner", exists, err)
+	}
+	if _, exists, err := db.RenameURL("missing", "fresh", "owner"); exists || err != nil {
+		t.Errorf("RenameURL(missing) = %v, %v, want not found", exists, err)
+	}
+	if _, _, err := db.RenameURL(old.ShortCode, taken.ShortCode, "owner"); !errors.Is(err, ErrCodeExists) {
+		t.Errorf("RenameURL onto a live code = %v, want ErrCodeExists", err)
+	}
+
+	mapping, exists, err := db.RenameURL(old.ShortCode, "fresh", "owner")
+	if err != nil || !exists {
+		t.Fatalf("RenameURL = %v, %v", exists, err)
+	}
+	if mapping.ID != old.ID || mapping.ShortCode != "fresh" || mapping.Clicks != 1 {
+		t.Errorf("renamed = %+v, want id %d with 1 click under \"fresh\"", mapping, old.ID)
+	}
+	if _, exists, err := db.GetURL(old.ShortCode); err != nil || exists {
+		t.Errorf("GetURL(old) = %v, %v, want it gone", exists, err)
+	}
+
+	var visits int
+	if err := db.conn.QueryRow(db.query(`SELECT COUNT(*) FROM {prefix}visits WHERE short_code = 'fresh'`)).Scan(&visits); err != nil {
+		t.Fatal(err)
+	}
+	if visits != 1 {
+		t.Errorf("%d visits under the new code, want 1", visits)
+	}
+}
+
+func TestIntegrationGetCountryCounts(t *testing.T) {
+	db, _ := newTestDatabase(t, nil)
+
+	for _, v := range []struct{ namespace, code, country string }{
+		{"", "abc", "DE"}, {"", "abc", "FR"}, {"", "abc", "DE"}, {"", "abc", ""},
+		{"team", "abc", "US"}, {"", "other", "DE"},
+	} {
+		if err := db.RecordVisit(v.namespace, v.code, "", "", v.country); err != nil {
+			t.Fatal("RecordVisit: ", err)
+		}
+	}
+	// Visits recorded before the country column existed are NULL
+	if _, err := db.conn.Exec(db.query(`INSERT INTO {prefix}visits (short_code) VALUES ('abc')`)); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := db.GetCountryCounts("abc")
+	if err != nil {
+		t.Fatal("GetCountryCounts: ", err)
+	}
+	if want := map[string]int64{"DE": 2, "FR": 1, "": 2}; !maps.Equal(counts, want) {
+		t.Errorf("GetCountryCounts = %v, want %v", counts, want)
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory Store for handler tests. It follows *Database
+// closely enough for the HTTP layer: sequential IDs, codes unique per
+// namespace, expired codes reclaimed on save, ownership checks and exact
+// click limits. The behaviour of the SQL itself is covered by the
+// integration tests.
+type memStore struct {
+	mu     sync.Mutex
+	seq    int64         // Last ID handed out, like the urls_id_seq sequence
+	links  []*URLMapping // In ID order
+	visits []memVisit
+	err    error // Returned by Ping when set
+}
+
+// memVisit is a row of the visits table
+type memVisit struct {
+	Namespace string
+	ShortCode string
+	Referrer  string
+	UserAgent string
+	Country   string
+	VisitedAt time.Time
+}
+
+func newMemStore(mappings ...URLMapping) *memStore {
+	s := &memStore{}
+	for _, m := range mappings {
+		s.add(m)
+	}
+	return s
+}
+
+// add stores m as is (taking the next ID when it has none) and returns its ID
+func (s *memStore) add(m URLMapping) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert(m)
+}
+
+func (s *memStore) insert(m URLMapping) int64 {
+	if m.ID == 0 {
+		s.seq++
+		m.ID = s.seq
+	}
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now().UTC()
+	}
+	s.links = append(s.links, &m)
+	return m.ID
+}
+
+// find returns the link holding namespace/shortCode, or nil
+func (s *memStore) find(namespace, shortCode string) *URLMapping {
+	for _, m := range s.links {
+		if m.Namespace == namespace && m.ShortCode == shortCode {
+			return m
+		}
+	}
+	return nil
+}
+
+// remove deletes the link with the given ID
+func (s *memStore) remove(id int64) {
+	for i, m := range s.links {
+		if m.ID == id {
+			s.links = append(s.links[:i], s.links[i+1:]...)
+			return
+		}
+	}
+}
+
+// claim makes namespace/shortCode available, reclaiming it from an expired
+// link, or fails with ErrCodeExists
+func (s *memStore) claim(namespace, shortCode string) error {
+	existing := s.find(namespace, shortCode)
+	if existing == nil {
+		return nil
+	}
+	if !existing.Expired() {
+		return fmt.Errorf("%w: %s", ErrCodeExists, shortCode)
+	}
+
+	s.remove(existing.ID)
+	s.dropVisits(namespace, shortCode)
+	return nil
+}
+
+// dropVisits forgets the visits recorded for namespace/shortCode, as the
+// database does when their link is deleted
+func (s *memStore) dropVisits(namespace, shortCode string) {
+	visits := s.visits[:0]
+	for _, v := range s.visits {
+		if v.Namespace != namespace || v.ShortCode != shortCode {
+			visits = append(visits, v)
+		}
+	}
+	s.visits = visits
+}
+
+func (s *memStore) SaveURL(mapping *URLMapping) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.claim(mapping.Namespace, mapping.ShortCode); err != nil {
+		return 0, err
+	}
+
+	m := *mapping
+	m.ID, m.CreatedAt = 0, time.Time{}
+	return s.insert(m), nil
+}
+
+func (s *memStore) CreateURL(mapping *URLMapping) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createSequential(mapping)
+}
+
+func (s *memStore) createSequential(mapping *URLMapping) error {
+	// Like Database.insertSequential, skip IDs whose code is already held
+	code := generateShortCode(s.seq + 1)
+	for s.find(mapping.Namespace, code) != nil {
+		s.seq++
+		code = generateShortCode(s.seq + 1)
+	}
+
+	m := *mapping
+	m.ID, m.ShortCode, m.CreatedAt = 0, code, time.Time{}
+	mapping.ID = s.insert(m)
+	mapping.ShortCode = code
+	return nil
+}
+
+func (s *memStore) RegenerateURL(shortCode, owner string) (*URLMapping, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.find("", shortCode)
+	if old == nil {
+		return nil, false, nil
+	}
+	if old.Owner != owner {
+		return nil, true, ErrNotOwner
+	}
+
+	mapping := *old
+	mapping.Clicks = 0
+	if err := s.createSequential(&mapping); err != nil {
+		return nil, false, err
+	}
+	s.remove(old.ID)
+	s.dropVisits("", shortCode)
+
+	return &mapping, true, nil
+}
+
+func (s *memStore) RenameURL(shortCode, newCode, owner string) (*URLMapping, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link := s.find("", shortCode)
+	if link == nil {
+		return nil, false, nil
+	}
+	if link.Owner != owner {
+		return nil, true, ErrNotOwner
+	}
+	if err := s.claim("", newCode); err != nil {
+		return nil, true, err
+	}
+
+	link.ShortCode = newCode
+	for i := range s.visits {
+		if s.visits[i].Namespace == "" && s.visits[i].ShortCode == shortCode {
+			s.visits[i].ShortCode = newCode
+		}
+	}
+	if id, err := decodeShortCode(newCode); err == nil && generateShortCode(id) == newCode {
+		s.seq = max(s.seq, id)
+	}
+
+	mapping := *link
+	return &mapping, true, nil
+}
+
+func (s *memStore) DeleteWhere(olderThan *time.Time, prefix, owner string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	kept := s.links[:0]
+	for _, m := range s.links {
+		if m.Owner == owner &&
+			(olderThan == nil || m.CreatedAt.Before(*olderThan)) &&
+			strings.HasPrefix(m.ShortCode, prefix) {
+			s.dropVisits(m.Namespace, m.ShortCode)
+			deleted++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	s.links = kept
+	return deleted, nil
+}
+
+func (s *memStore) DeleteURL(shortCode, owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.find("", shortCode)
+	if m == nil {
+		return false, nil
+	}
+	if m.Owner != owner {
+		return true, ErrNotOwner
+	}
+	s.remove(m.ID)
+	s.dropVisits("", shortCode)
+	return true, nil
+}
+
+func (s *memStore) DeleteURLs(codes []string, owner string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted []string
+	for _, code := range codes {
+		if m := s.find("", code); m != nil && m.Owner == owner {
+			s.remove(m.ID)
+			s.dropVisits("", code)
+			deleted = append(deleted, code)
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memStore) ExportURLs(owner string, fn func(*URLMapping) error) error {
+	for _, m := range s.snapshot() {
+		if m.Owner != owner {
+			continue
+		}
+		if err := fn(&m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot copies every link, in ID order
+func (s *memStore) snapshot() []URLMapping {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mappings := make([]URLMapping, len(s.links))
+	for i, m := range s.links {
+		mappings[i] = *m
+	}
+	return mappings
+}
+
+func (s *memStore) CountOwnedURLs(owner string) (int64, error) {
+	var count int64
+	for _, m := range s.snapshot() {
+		if m.Owner == owner {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memStore) ImportURLs(mappings []URLMapping, owner, onConflict string) (*ImportResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Work on a copy so an aborted import changes nothing, like the rollback
+	links := make([]*URLMapping, len(s.links))
+	for i, m := range s.links {
+		copied := *m
+		links[i] = &copied
+	}
+	saved, seq := s.links, s.seq
+	s.links = links
+
+	result := &ImportResult{}
+	for _, m := range mappings {
+		m.Owner = owner
+		if existing := s.find(m.Namespace, m.ShortCode); existing != nil {
+			switch onConflict {
+			case conflictSkip:
+				result.Skipped++
+				continue
+			case conflictOverwrite:
+				if existing.Owner != owner {
+					result.Skipped++
+					continue
+				}
+				m.ID = existing.ID
+				*existing = m
+				result.Overwritten++
+			default:
+				s.links, s.seq = saved, seq
+				return nil, fmt.Errorf("%w: %s", ErrCodeConflict, m.ShortCode)
+			}
+		} else {
+			m.ID = 0
+			s.insert(m)
+			result.Imported++
+		}
+
+		if id, err := decodeShortCode(m.ShortCode); err == nil && generateShortCode(id) == m.ShortCode {
+			s.seq = max(s.seq, id)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *memStore) GetURL(shortCode string) (*URLMapping, bool, error) {
+	return s.GetNamespacedURL("", shortCode)
+}
+
+func (s *memStore) GetNamespacedURL(namespace, shortCode string) (*URLMapping, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.find(namespace, shortCode)
+	if m == nil {
+		return nil, false, nil
+	}
+	mapping := *m
+	return &mapping, true, nil
+}
+
+func (s *memStore) GetURLs(shortCodes []string) (map[string]URLMapping, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mappings := make(map[string]URLMapping, len(shortCodes))
+	for _, code := range shortCodes {
+		if m := s.find("", code); m != nil {
+			mappings[code] = *m
+		}
+	}
+	return mappings, nil
+}
+
+func (s *memStore) GetURLCaseInsensitive(code string) ([]URLMapping, error) {
+	mappings := []URLMapping{}
+	for _, m := range s.snapshot() {
+		if strings.EqualFold(m.ShortCode, code) {
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings, nil
+}
+
+func (s *memStore) ListRecentURLs(owner string, afterID int64, limit int) ([]URLMapping, error) {
+	links := s.snapshot()
+	mappings := []URLMapping{}
+	for i := len(links) - 1; i >= 0 && len(mappings) < limit; i-- {
+		if m := links[i]; m.Owner == owner && (afterID <= 0 || m.ID < afterID) {
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings, nil
+}
+
+func (s *memStore) GetURLFields(shortCode string, fields []string) (map[string]any, bool, error) {
+	m, exists, _ := s.GetURL(shortCode)
+	if !exists {
+		return nil, false, nil
+	}
+
+	// The values the driver would scan, with NULLs left out
+	values := map[string]any{
+		"id":           m.ID,
+		"short_code":   m.ShortCode,
+		"original_url": m.OriginalURL,
+		"clicks":       m.Clicks,
+		"created_at":   m.CreatedAt,
+		"max_clicks":   m.MaxClicks,
+		"disabled":     m.Disabled,
+	}
+	if m.ExpiresAt != nil {
+		values["expires_at"] = *m.ExpiresAt
+	}
+	for field, value := range map[string]string{
+		"title":        m.Title,
+		"description":  m.Description,
+		"utm_source":   m.UTMSource,
+		"utm_medium":   m.UTMMedium,
+		"utm_campaign": m.UTMCampaign,
+	} {
+		if value != "" {
+			values[field] = value
+		}
+	}
+
+	result := make(map[string]any, len(fields))
+	for _, field := range fields {
+		if _, ok := urlFieldColumns[field]; !ok {
+			return nil, false, fmt.Errorf("unknown field %q", field)
+		}
+		if value, ok := values[field]; ok {
+			result[field] = value
+		}
+	}
+	return result, true, nil
+}
+
+func (s *memStore) GetNextID() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	return s.seq, nil
+}
+
+func (s *memStore) GetSequence() (lastValue, nextID int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return max(s.seq, 1), s.seq + 1, nil
+}
+
+func (s *memStore) SetSequence(value int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.links {
+		if m.ID >= value {
+			return ErrSequenceTooLow
+		}
+	}
+	s.seq = value
+	return nil
+}
+
+func (s *memStore) IncrementClicks(shortCode string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.find("", shortCode)
+	if m == nil {
+		return 0, sql.ErrNoRows
+	}
+	m.Clicks++
+	return m.Clicks, nil
+}
+
+func (s *memStore) AddClicks(increments map[string]int64) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int64, len(increments))
+	for code, delta := range increments {
+		if m := s.find("", code); m != nil {
+			m.Clicks += delta
+			counts[code] = m.Clicks
+		}
+	}
+	return counts, nil
+}
+
+func (s *memStore) RecordVisit(namespace, shortCode, referrer, userAgent, country string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.visits = append(s.visits, memVisit{
+		Namespace: namespace,
+		ShortCode: shortCode,
+		Referrer:  referrer,
+		UserAgent: userAgent,
+		Country:   country,
+		VisitedAt: time.Now().UTC(),
+	})
+	return nil
+}
+
+// recordedVisits returns a copy of the visits table
+func (s *memStore) recordedVisits() []memVisit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]memVisit(nil), s.visits...)
+}
+
+func (s *memStore) GetCountryCounts(shortCode string) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for _, v := range s.recordedVisits() {
+		if v.Namespace == "" && v.ShortCode == shortCode {
+			counts[v.Country]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *memStore) GetVisitCounts(shortCode, bucket string, from, to time.Time) (map[time.Time]int64, error) {
+	counts := make(map[time.Time]int64)
+	for _, v := range s.recordedVisits() {
+		if v.Namespace == "" && v.ShortCode == shortCode && !v.VisitedAt.Before(from) && v.VisitedAt.Before(to) {
+			counts[truncateToBucket(v.VisitedAt, bucket)]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *memStore) ConsumeClick(id int64) (clicks int64, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.links {
+		if m.ID != id {
+			continue
+		}
+		if m.Disabled || (m.MaxClicks > 0 && m.Clicks >= m.MaxClicks) {
+			return 0, false, nil
+		}
+		m.Clicks++
+		m.Disabled = m.MaxClicks > 0 && m.Clicks >= m.MaxClicks
+		return m.Clicks, true, nil
+	}
+	return 0, false, nil
+}
+
+func (s *memStore) Stats() sql.DBStats {
+	return sql.DBStats{MaxOpenConnections: 10, OpenConnections: 1, Idle: 1}
+}
+
+func (s *memStore) Summary() (*SummaryResponse, error) {
+	summary := &SummaryResponse{}
+	dayAgo := time.Now().Add(-24 * time.Hour)
+	for _, m := range s.snapshot() {
+		summary.TotalLinks++
+		summary.TotalClicks += m.Clicks
+		if !m.CreatedAt.Before(dayAgo) {
+			summary.LinksLast24h++
+		}
+		if summary.LatestCreatedAt == nil || m.CreatedAt.After(*summary.LatestCreatedAt) {
+			createdAt := m.CreatedAt
+			summary.LatestCreatedAt = &createdAt
+		}
+	}
+	return summary, nil
+}
+
+func (s *memStore) Analyze() (*AnalyzeResponse, error) {
+	return &AnalyzeResponse{Table: "urls", Rows: int64(len(s.snapshot()))}, nil
+}
+
+func (s *memStore) Ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *memStore) CodeExists(shortCode string) (bool, error) {
+	m, exists, _ := s.GetURL(shortCode)
+	return exists && !m.Expired(), nil
+}
+
+func (s *memStore) GetRank(id int64, shortCode string) (int64, bool, error) {
+	var rank int64
+	found := false
+	for _, m := range s.snapshot() {
+		if m.ID <= id {
+			rank++
+		}
+		if m.ID == id && m.ShortCode == shortCode {
+			found = true
+		}
+	}
+	return rank, found, nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// noQueryStore fails the test on any lookup, for checking that a request
+// is answered without touching the database. Other methods go to the
+// embedded Store, if any.
+type noQueryStore struct {
+	Store
+	t *testing.T
+}
+
+func (s noQueryStore) GetURL(shortCode string) (*URLMapping, bool, error) {
+	s.t.Errorf("unexpected GetURL(%q)", shortCode)
+	return nil, false, nil
+}
+
+func (s noQueryStore) GetNamespacedURL(namespace, shortCode string) (*URLMapping, bool, error) {
+	s.t.Errorf("unexpected GetNamespacedURL(%q, %q)", namespace, shortCode)
+	return nil, false, nil
+}